@@ -8,16 +8,25 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/build"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"text/template"
 )
 
 var (
@@ -30,11 +39,27 @@ var (
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\t%s [command]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%s -o file.tar.gz\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "For example:\n")
 	fmt.Fprintf(os.Stderr, "\t%s tar zcvf $PWD/app.tar.gz .\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
 }
 
-var verbose bool
+var (
+	verbose bool
+
+	goos              string
+	goarch            string
+	tags              string
+	cgo               bool
+	ignoreBuildErrors bool
+	output            string
+
+	overlay        string
+	dockerfile     string
+	synthesizeMain bool
+)
 
 // vlogf logs to stderr if the "-v" flag is provided.
 func vlogf(f string, v ...interface{}) {
@@ -46,9 +71,18 @@ func vlogf(f string, v ...interface{}) {
 
 func main() {
 	flag.BoolVar(&verbose, "v", false, "Verbose logging.")
+	flag.StringVar(&goos, "goos", "linux", "GOOS to build for.")
+	flag.StringVar(&goarch, "goarch", "amd64", "GOARCH to build for.")
+	flag.StringVar(&tags, "tags", "", "Comma-separated list of build tags.")
+	flag.BoolVar(&cgo, "cgo", false, "Enable cgo.")
+	flag.BoolVar(&ignoreBuildErrors, "ignore-build-errors", false, "Ignore errors encountered while resolving imports, instead of aborting.")
+	flag.StringVar(&output, "o", "", `Write a deterministic tar (or tar.gz, by extension) archive of the bundle to this file instead of running a deploy command. Use "-" for stdout.`)
+	flag.StringVar(&overlay, "overlay", "", "Copy this directory tree over the bundled root last, so its files take precedence.")
+	flag.StringVar(&dockerfile, "dockerfile", "", "Render this text/template file (with .ImportPath, .Binary, .GOOS, .GOARCH, .Tags) and write it as Dockerfile in the bundled root.")
+	flag.BoolVar(&synthesizeMain, "synthesize-main", false, "Synthesize a minimal main.go if the target package doesn't already define func main().")
 	flag.Usage = usage
 	flag.Parse()
-	if flag.NArg() < 1 {
+	if output == "" && flag.NArg() < 1 {
 		usage()
 		os.Exit(1)
 	}
@@ -73,6 +107,10 @@ func bundle() error {
 		return err
 	}
 
+	if output != "" {
+		return writeArchive(tmpDir, output)
+	}
+
 	if err := os.Chdir(tmpDir); err != nil {
 		return fmt.Errorf("unable to chdir to %v: %v", tmpDir, err)
 	}
@@ -90,30 +128,183 @@ func deploy() error {
 	return nil
 }
 
+// writeArchive writes a deterministic tar archive (gzip-compressed if name ends in ".gz")
+// of srcDir to name. Use "-" for stdout.
+func writeArchive(srcDir, name string) error {
+	f := os.Stdout
+	if name != "-" {
+		var err error
+		f, err = os.Create(name)
+		if err != nil {
+			return fmt.Errorf("unable to create %q: %v", name, err)
+		}
+	}
+
+	var w io.Writer = f
+	var gw *gzip.Writer
+	if strings.HasSuffix(name, ".gz") {
+		gw = gzip.NewWriter(f)
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+	if err := addTarTree(tw, srcDir); err != nil {
+		return fmt.Errorf("unable to write archive: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("unable to close tar writer: %v", err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("unable to close gzip writer: %v", err)
+		}
+	}
+	if f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("unable to close %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// addTarTree walks srcDir in sorted order and writes each entry to tw with a
+// deterministic header: zeroed mtime/uid/gid and forced permissions, so the resulting
+// archive is byte-identical across machines. Symlinks are resolved to regular files or
+// directories, as appropriate; a symlink to a directory has its contents walked and
+// archived too, not just an empty directory entry.
+func addTarTree(tw *tar.Writer, srcDir string) error {
+	return addTarDir(tw, srcDir, "")
+}
+
+// addTarDir writes the contents of the directory srcDir into tw, with archive paths
+// prefixed by rel (a slash-separated path, "" at the root). It recurses manually,
+// rather than using filepath.Walk, so that symlinks to directories are traversed: Walk
+// decides whether to recurse from the pre-symlink Lstat, so it never descends into a
+// symlinked directory even if the callback re-stats it.
+func addTarDir(tw *tar.Writer, srcDir, rel string) error {
+	entries, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return fmt.Errorf("unable to read dir %q: %v", srcDir, err)
+	}
+	for _, entry := range entries {
+		n := entry.Name()
+		path := filepath.Join(srcDir, n)
+		name := rel + n
+
+		info := os.FileInfo(entry)
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			if info, err = os.Stat(path); err != nil {
+				return fmt.Errorf("unable to stat %q: %v", path, err)
+			}
+		}
+
+		if info.IsDir() {
+			hdr := &tar.Header{Name: name + "/", Mode: 0755, Typeflag: tar.TypeDir}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("unable to write header for %q: %v", hdr.Name, err)
+			}
+			if err := addTarDir(tw, path, name+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("unable to write header for %q: %v", name, err)
+		}
+		if err := func() error {
+			src, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("unable to open %q: %v", path, err)
+			}
+			defer src.Close()
+			if _, err := io.Copy(tw, src); err != nil {
+				return fmt.Errorf("unable to write %q to archive: %v", name, err)
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type app struct {
+	// imports maps an import path to the source directory it resolves to. The import
+	// path reflects any vendor/ nesting (e.g. "a/vendor/x"), so that packages vendored
+	// by multiple imports at different versions get distinct entries.
 	imports map[string]string
+
+	// modules holds the vendored module metadata when the app was analyzed in
+	// modules mode. It is nil when the app was analyzed in GOPATH mode.
+	modules []vendoredModule
+
+	// importPath is the app's own best-effort import path, used to populate
+	// -dockerfile templates. It is "" if it couldn't be determined.
+	importPath string
+}
+
+// binary returns the name of the binary the app is expected to build as, for use in
+// -dockerfile templates.
+func (s *app) binary() string {
+	if s.importPath != "" {
+		return filepath.Base(s.importPath)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "app"
+	}
+	return filepath.Base(wd)
 }
 
 // analyze checks the app for building and returns a map of imports to directory names.
 func analyze() (*app, error) {
 	ctxt := buildContext()
 	vlogf("Using build context %#v", ctxt)
+
+	if _, err := os.Stat("go.mod"); err == nil {
+		vlogf("Found go.mod, using modules mode")
+		im, mods, rootImportPath, err := modulesImports(ctxt)
+		return &app{imports: im, modules: mods, importPath: rootImportPath}, err
+	}
+
 	im, err := imports(ctxt, ".")
 	return &app{
-		imports: im,
+		imports:    im,
+		importPath: rootImportPath(ctxt),
 	}, err
 }
 
+// rootImportPath returns the app's own best-effort import path, derived from its
+// location on disk relative to GOPATH. It returns "" if that can't be determined (e.g.
+// the app isn't under any GOPATH src tree).
+func rootImportPath(ctxt *build.Context) string {
+	pkg, _ := ctxt.ImportDir(".", 0)
+	if pkg == nil {
+		return ""
+	}
+	path, err := canonicalImportPath(ctxt, pkg)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
 // buildContext returns the context for greedily finding dependencies.
 func buildContext() *build.Context {
-	return &build.Context{
-		GOARCH:      "amd64",
-		GOOS:        "linux",
-		GOROOT:      build.Default.GOROOT,
-		GOPATH:      build.Default.GOPATH,
-		Compiler:    build.Default.Compiler,
-		UseAllFiles: true,
+	ctxt := &build.Context{
+		GOARCH:     goarch,
+		GOOS:       goos,
+		GOROOT:     build.Default.GOROOT,
+		GOPATH:     build.Default.GOPATH,
+		Compiler:   build.Default.Compiler,
+		CgoEnabled: cgo,
+	}
+	if tags != "" {
+		ctxt.BuildTags = strings.Split(tags, ",")
 	}
+	return ctxt
 }
 
 // bundle bundles the app into a temporary directory.
@@ -123,20 +314,66 @@ func (s *app) bundle() (tmpdir string, err error) {
 		return "", fmt.Errorf("unable to create tmpdir: %v", err)
 	}
 
-	for srcDir, importName := range s.imports {
+	names := make([]string, 0, len(s.imports))
+	for name := range s.imports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	copiedFrom := make(map[string]string) // source directory -> first vendor path it was copied to
+	for _, importName := range names {
+		srcDir := s.imports[importName]
 		dstDir := "vendor/" + importName
+		if first, ok := copiedFrom[srcDir]; ok {
+			// Same source directory already vendored under a different import path.
+			if err := linkTree(workDir, dstDir, first); err != nil {
+				return workDir, fmt.Errorf("unable to link directory %v to %v: %v", srcDir, dstDir, err)
+			}
+			continue
+		}
 		if err := copyTree(workDir, dstDir, srcDir); err != nil {
 			return workDir, fmt.Errorf("unable to copy directory %v to %v: %v", srcDir, dstDir, err)
 		}
+		copiedFrom[srcDir] = dstDir
+	}
+	if s.modules != nil {
+		if err := writeModulesTxt(workDir, s.modules); err != nil {
+			return workDir, err
+		}
 	}
 	if err := copyTree(workDir, ".", "."); err != nil {
 		return workDir, fmt.Errorf("unable to copy root directory to /app: %v", err)
 	}
+
+	if synthesizeMain {
+		has, err := hasMainFunc(".")
+		if err != nil {
+			return workDir, fmt.Errorf("unable to check for func main: %v", err)
+		}
+		if !has {
+			if err := writeMainShim(workDir); err != nil {
+				return workDir, err
+			}
+		}
+	}
+
+	if dockerfile != "" {
+		if err := writeDockerfile(workDir, s); err != nil {
+			return workDir, err
+		}
+	}
+
+	if overlay != "" {
+		if err := copyTree(workDir, ".", overlay); err != nil {
+			return workDir, fmt.Errorf("unable to copy overlay %v to %v: %v", overlay, workDir, err)
+		}
+	}
+
 	return workDir, nil
 }
 
-// imports returns a map of all import directories used by the app.
-// The return value maps full directory names to original import names.
+// imports returns a map of all non-standard-library packages imported by the app.
+// The return value maps each package's canonical import path to its source directory.
 func imports(ctxt *build.Context, srcDir string) (map[string]string, error) {
 	result := make(map[string]string)
 
@@ -147,8 +384,8 @@ func imports(ctxt *build.Context, srcDir string) (map[string]string, error) {
 	visited := make(map[importFrom]bool)
 
 	pkg, err := ctxt.ImportDir(srcDir, 0)
-	if err != nil {
-		// Ignore error (hopefully due to bad build tags).
+	if err != nil && !ignoreBuildErrors {
+		return nil, fmt.Errorf("unable to import %q: %v", srcDir, err)
 	}
 	for _, v := range pkg.Imports {
 		imports = append(imports, importFrom{
@@ -176,12 +413,10 @@ func imports(ctxt *build.Context, srcDir string) (map[string]string, error) {
 			return nil, fmt.Errorf("unable to get absolute directory of %q: %v", i.fromDir, err)
 		}
 		pkg, err := ctxt.Import(i.path, abs, 0)
-		if err != nil {
-			// Ignore error (hopefully due to bad build tags).
+		if err != nil && !ignoreBuildErrors {
+			return nil, fmt.Errorf("unable to import %q (imported from %q): %v", i.path, i.fromDir, err)
 		}
 
-		// TODO(cbro): handle packages that are vendored by multiple imports correctly.
-
 		if pkg.Goroot {
 			// ignore standard library imports
 			continue
@@ -192,8 +427,15 @@ func imports(ctxt *build.Context, srcDir string) (map[string]string, error) {
 			continue
 		}
 
-		vlogf("Located %q (imported from %q) -> %q", i.path, i.fromDir, pkg.Dir)
-		result[pkg.Dir] = i.path
+		name, err := canonicalImportPath(ctxt, pkg)
+		if err != nil {
+			return nil, err
+		}
+		if existing, ok := result[name]; ok && existing != pkg.Dir {
+			return nil, fmt.Errorf("import path %q resolves to both %q and %q", name, existing, pkg.Dir)
+		}
+		vlogf("Located %q (imported from %q) -> %q as %q", i.path, i.fromDir, pkg.Dir, name)
+		result[name] = pkg.Dir
 
 		for _, v := range pkg.Imports {
 			imports = append(imports, importFrom{
@@ -206,6 +448,342 @@ func imports(ctxt *build.Context, srcDir string) (map[string]string, error) {
 	return result, nil
 }
 
+// canonicalImportPath returns the import path of pkg as determined by its location on
+// disk, relative to whichever GOPATH src directory contains it. Unlike the import string
+// written in source, this reflects any vendor/ nesting (e.g. "a/vendor/x"), so it uniquely
+// identifies a package even when two nested vendor trees vendor the same import path at
+// different versions.
+func canonicalImportPath(ctxt *build.Context, pkg *build.Package) (string, error) {
+	for _, gopath := range filepath.SplitList(ctxt.GOPATH) {
+		srcDir := filepath.Join(gopath, "src")
+		rel, err := filepath.Rel(srcDir, pkg.Dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return filepath.ToSlash(rel), nil
+	}
+	// Not under any GOPATH src directory; fall back to the import path as written.
+	return pkg.ImportPath, nil
+}
+
+// linkTree replicates the tree already copied at srcDir (relative to dstRoot) into dstDir
+// (also relative to dstRoot) using hardlinks. It's used when the same source directory is
+// vendored under more than one import path, to avoid reading the source twice.
+func linkTree(dstRoot, dstDir, srcDir string) error {
+	absSrc := filepath.Join(dstRoot, srcDir)
+	absDst := filepath.Join(dstRoot, dstDir)
+	if err := os.MkdirAll(absDst, 0755); err != nil {
+		return fmt.Errorf("unable to create directory %q: %v", absDst, err)
+	}
+
+	entries, err := ioutil.ReadDir(absSrc)
+	if err != nil {
+		return fmt.Errorf("unable to read dir %q: %v", absSrc, err)
+	}
+	for _, entry := range entries {
+		s := filepath.Join(srcDir, entry.Name())
+		d := filepath.Join(dstDir, entry.Name())
+		if entry.IsDir() {
+			if err := linkTree(dstRoot, d, s); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Link(filepath.Join(dstRoot, s), filepath.Join(dstRoot, d)); err != nil {
+			return fmt.Errorf("unable to link %q to %q: %v", s, d, err)
+		}
+	}
+	return nil
+}
+
+// hasMainFunc reports whether the package in dir already declares a func main().
+func hasMainFunc(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, fmt.Errorf("unable to read dir %q: %v", dir, err)
+	}
+
+	fset := token.NewFileSet()
+	for _, entry := range entries {
+		n := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(n, ".go") || strings.HasSuffix(n, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, n), nil, 0)
+		if err != nil {
+			return false, fmt.Errorf("unable to parse %q: %v", n, err)
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// mainShim is a minimal package main, written to the bundled root when the target
+// package doesn't already declare func main().
+const mainShim = `package main
+
+func main() {}
+`
+
+// writeMainShim writes mainShim to workDir's root.
+func writeMainShim(workDir string) error {
+	dst := filepath.Join(workDir, "synthesized_main.go")
+	if err := ioutil.WriteFile(dst, []byte(mainShim), 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %v", dst, err)
+	}
+	return nil
+}
+
+// dockerfileData is the template data available to the -dockerfile template.
+type dockerfileData struct {
+	ImportPath string
+	Binary     string
+	GOOS       string
+	GOARCH     string
+	Tags       string
+}
+
+// writeDockerfile renders the -dockerfile template and writes the result to workDir's
+// root as "Dockerfile".
+func writeDockerfile(workDir string, s *app) error {
+	tmpl, err := template.ParseFiles(dockerfile)
+	if err != nil {
+		return fmt.Errorf("unable to parse dockerfile template %q: %v", dockerfile, err)
+	}
+
+	dst := filepath.Join(workDir, "Dockerfile")
+	f, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("unable to create %q: %v", dst, err)
+	}
+	data := dockerfileData{
+		ImportPath: s.importPath,
+		Binary:     s.binary(),
+		GOOS:       goos,
+		GOARCH:     goarch,
+		Tags:       tags,
+	}
+	if err := tmpl.Execute(f, data); err != nil {
+		f.Close() // ignore error, render already failed.
+		return fmt.Errorf("unable to render dockerfile template: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close %q: %v", dst, err)
+	}
+	return nil
+}
+
+// goListPackage is the subset of `go list -json` fields needed to populate an app's imports.
+type goListPackage struct {
+	Dir        string
+	ImportPath string
+	Standard   bool
+	Goroot     bool
+	Module     *goListModule
+	Error      *goListError
+}
+
+// goListError is the per-package error `go list -e` reports instead of failing outright.
+type goListError struct {
+	Err string
+}
+
+// goListModule is the subset of `go list -m -json` fields needed to track vendored modules.
+type goListModule struct {
+	Path     string
+	Version  string
+	Main     bool
+	Indirect bool
+	Replace  *goListModule
+}
+
+// vendoredModule describes a module to be recorded in a synthesized vendor/modules.txt.
+type vendoredModule struct {
+	path     string
+	version  string
+	explicit bool
+	pkgs     []string
+
+	// replace is the "=> ..." target from the module's go.mod replace directive, already
+	// formatted for modules.txt (e.g. "../dep" or "example.com/fork v1.4.0"), or "" if the
+	// module isn't replaced.
+	replace string
+}
+
+// modulesImports resolves the app's dependencies using Go modules instead of GOPATH, by
+// shelling out to `go list` rather than walking ctxt.Imports recursively. It returns the
+// same import-path-to-directory mapping as imports, the set of modules that need to be
+// recorded in vendor/modules.txt, and the main module's own import path.
+func modulesImports(ctxt *build.Context) (map[string]string, []vendoredModule, string, error) {
+	meta, err := moduleMeta(ctxt)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	args := []string{"list", "-deps", "-json", "-e"}
+	if len(ctxt.BuildTags) > 0 {
+		args = append(args, "-tags="+strings.Join(ctxt.BuildTags, ","))
+	}
+	out, err := goList(ctxt, append(args, ".")...)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	result := make(map[string]string)
+	mods := make(map[string]*vendoredModule)
+	var rootImportPath string
+	var errs []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg goListPackage
+		if err := dec.Decode(&pkg); err != nil {
+			return nil, nil, "", fmt.Errorf("unable to decode go list output: %v", err)
+		}
+		if pkg.Error != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", pkg.ImportPath, pkg.Error.Err))
+			continue
+		}
+		if pkg.Standard || pkg.Goroot || pkg.Dir == "" {
+			// standard library, or couldn't find package (hopefully due to bad build tags).
+			continue
+		}
+		if pkg.Module == nil || pkg.Module.Main {
+			// part of the main module; it's copied as the app root, not vendored.
+			if pkg.Module != nil && pkg.Module.Main {
+				rootImportPath = pkg.ImportPath
+			}
+			continue
+		}
+
+		vlogf("Located %q -> %q", pkg.ImportPath, pkg.Dir)
+		result[pkg.ImportPath] = pkg.Dir
+
+		m := mods[pkg.Module.Path]
+		if m == nil {
+			m = &vendoredModule{
+				path:     pkg.Module.Path,
+				version:  pkg.Module.Version,
+				explicit: !meta[pkg.Module.Path].Indirect,
+				replace:  replaceTarget(meta[pkg.Module.Path].Replace),
+			}
+			mods[pkg.Module.Path] = m
+		}
+		m.pkgs = append(m.pkgs, pkg.ImportPath)
+	}
+
+	if len(errs) > 0 && !ignoreBuildErrors {
+		return nil, nil, "", fmt.Errorf("unable to resolve imports:\n%s", strings.Join(errs, "\n"))
+	}
+
+	var entries []vendoredModule
+	for _, m := range mods {
+		sort.Strings(m.pkgs)
+		entries = append(entries, *m)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return result, entries, rootImportPath, nil
+}
+
+// moduleMeta returns, for each module required by the app, whether it is only an indirect
+// dependency and what (if anything) it's replaced by. It mirrors the "## explicit" marker
+// and replace directives that `go mod vendor` records in modules.txt.
+func moduleMeta(ctxt *build.Context) (map[string]goListModule, error) {
+	args := []string{"list", "-m", "-json"}
+	if len(ctxt.BuildTags) > 0 {
+		args = append(args, "-tags="+strings.Join(ctxt.BuildTags, ","))
+	}
+	out, err := goList(ctxt, append(args, "all")...)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]goListModule)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var mod goListModule
+		if err := dec.Decode(&mod); err != nil {
+			return nil, fmt.Errorf("unable to decode go list -m output: %v", err)
+		}
+		meta[mod.Path] = mod
+	}
+	return meta, nil
+}
+
+// replaceTarget formats a module's "Replace" field as it appears after "=>" in
+// modules.txt, or "" if the module isn't replaced. A replacement with no version is a
+// local filesystem path; otherwise it's another module at a specific version.
+func replaceTarget(r *goListModule) string {
+	if r == nil {
+		return ""
+	}
+	if r.Version == "" {
+		return r.Path
+	}
+	return r.Path + " " + r.Version
+}
+
+// goList runs `go` with the given arguments, using ctxt's GOOS/GOARCH/CgoEnabled, and
+// returns stdout.
+func goList(ctxt *build.Context, args ...string) ([]byte, error) {
+	cmd := exec.Command("go", args...)
+	cgoEnabled := "0"
+	if ctxt.CgoEnabled {
+		cgoEnabled = "1"
+	}
+	cmd.Env = append(os.Environ(),
+		"GOOS="+ctxt.GOOS,
+		"GOARCH="+ctxt.GOARCH,
+		"CGO_ENABLED="+cgoEnabled,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to run %q: %v", strings.Join(cmd.Args, " "), err)
+	}
+	return out, nil
+}
+
+// writeModulesTxt synthesizes a vendor/modules.txt in the format `go mod vendor` produces,
+// so the bundled tree can be built with -mod=vendor.
+func writeModulesTxt(workDir string, mods []vendoredModule) error {
+	var buf bytes.Buffer
+	for _, m := range mods {
+		fmt.Fprintf(&buf, "# %s %s", m.path, m.version)
+		if m.replace != "" {
+			fmt.Fprintf(&buf, " => %s", m.replace)
+		}
+		buf.WriteString("\n")
+		if m.explicit {
+			buf.WriteString("## explicit\n")
+		}
+		for _, pkg := range m.pkgs {
+			fmt.Fprintf(&buf, "%s\n", pkg)
+		}
+	}
+	// go.mod replace directives are virtually always written without pinning a version
+	// on the left-hand side (e.g. "replace example.com/dep => ../dep"), which -mod=vendor's
+	// consistency check looks up by path alone; the version-specific "=> replacement"
+	// suffix on the header line above doesn't satisfy that lookup. Append a matching
+	// version-less line for every replaced module so both forms are covered.
+	for _, m := range mods {
+		if m.replace != "" {
+			fmt.Fprintf(&buf, "# %s => %s\n", m.path, m.replace)
+		}
+	}
+
+	dst := filepath.Join(workDir, "vendor", "modules.txt")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("unable to create vendor directory: %v", err)
+	}
+	if err := ioutil.WriteFile(dst, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("unable to write %q: %v", dst, err)
+	}
+	return nil
+}
+
 // copyTree copies srcDir to dstDir relative to dstRoot, ignoring skipFiles.
 func copyTree(dstRoot, dstDir, srcDir string) error {
 	vlogf("Copying %q to %q", srcDir, dstDir)
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes a file under root, creating parent directories as needed.
+func writeFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	p := filepath.Join(root, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatalf("MkdirAll(%q): %v", filepath.Dir(p), err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile(%q): %v", p, err)
+	}
+}
+
+// TestImportsNestedVendor builds a fixture where "example.com/app" imports both
+// "example.com/liba" and "example.com/shared" directly, and "example.com/liba" has its
+// own vendored copy of "example.com/shared" at a different version. go/build's vendor
+// semantics mean the same import string "example.com/shared" resolves to two different
+// directories depending on which package imports it.
+func TestImportsNestedVendor(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "gobundle-test-gopath")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(gopath)
+
+	src := filepath.Join(gopath, "src")
+	appDir := filepath.Join(src, "example.com", "app")
+
+	writeFile(t, src, "example.com/app/main.go", `package main
+
+import (
+	_ "example.com/liba"
+	_ "example.com/shared"
+)
+
+func main() {}
+`)
+	writeFile(t, src, "example.com/shared/shared.go", `package shared
+
+const Version = "top-level"
+`)
+	writeFile(t, src, "example.com/liba/liba.go", `package liba
+
+import _ "example.com/shared"
+`)
+	writeFile(t, src, "example.com/liba/vendor/example.com/shared/shared.go", `package shared
+
+const Version = "vendored-by-liba"
+`)
+
+	ctxt := &build.Context{
+		GOARCH:   build.Default.GOARCH,
+		GOOS:     build.Default.GOOS,
+		GOROOT:   build.Default.GOROOT,
+		GOPATH:   gopath,
+		Compiler: build.Default.Compiler,
+	}
+
+	got, err := imports(ctxt, appDir)
+	if err != nil {
+		t.Fatalf("imports: %v", err)
+	}
+
+	want := map[string]string{
+		"example.com/liba":                           filepath.Join(src, "example.com/liba"),
+		"example.com/shared":                         filepath.Join(src, "example.com/shared"),
+		"example.com/liba/vendor/example.com/shared": filepath.Join(src, "example.com/liba/vendor/example.com/shared"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("imports returned %d entries, want %d: %#v", len(got), len(want), got)
+	}
+	for name, dir := range want {
+		if got[name] != dir {
+			t.Errorf("imports[%q] = %q, want %q", name, got[name], dir)
+		}
+	}
+}